@@ -1,65 +1,289 @@
 package ddrv
 
 // Stripped down version of https://github.com/diamondburned/arikawa/blob/v3/api/rate/rate.go
-// This limiter does not lock the bucket, so all calls will be concurrent
 // Rest must retry on error code 429 as well.
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const ExtraDelay = 250 * time.Millisecond
 
+// ErrTimedOutEarly is returned by AcquireCtx when it declines to sleep out a
+// rate limit wait, either because the caller's context deadline would be
+// exceeded by the wait or because AcquireOptions.DontWait was set.
+var ErrTimedOutEarly = errors.New("ddrv: rate limit wait exceeded context deadline")
+
+// AcquireOptions controls how AcquireCtx behaves when a bucket is rate
+// limited. It is attached to a context.Context with WithAcquireOptions.
+type AcquireOptions struct {
+	// DontWait makes AcquireCtx return ErrTimedOutEarly immediately instead
+	// of sleeping whenever the bucket or global limit is currently exhausted.
+	DontWait bool
+}
+
+type acquireOptionsKey struct{}
+
+// WithAcquireOptions returns a copy of ctx carrying opts for AcquireCtx to
+// read.
+func WithAcquireOptions(ctx context.Context, opts AcquireOptions) context.Context {
+	return context.WithValue(ctx, acquireOptionsKey{}, opts)
+}
+
+func acquireOptionsFromContext(ctx context.Context) AcquireOptions {
+	opts, _ := ctx.Value(acquireOptionsKey{}).(AcquireOptions)
+	return opts
+}
+
 type Limiter struct {
 	bucketMu sync.Mutex
 	buckets  map[string]*bucket
-	global   time.Time
+
+	// global is a unix-nano timestamp of when the global rate limit clears,
+	// accessed atomically since Acquire and Release hit it from different
+	// goroutines with no other lock guarding it.
+	global *int64
+
+	// CustomLimits declares route-specific limits that Discord enforces but
+	// doesn't advertise in X-RateLimit-* headers, such as the reactions
+	// endpoint. A bucket whose normalized path contains Contains is rate
+	// limited locally to Requests per Reset; Release applies no response
+	// headers to such a bucket, so its limit comes from Requests/Reset alone
+	// (plus the global limit, which Acquire still checks).
+	CustomLimits []*CustomRateLimit
+}
+
+// CustomRateLimit declares a local rate limit for any bucket whose
+// normalized path contains Contains, for routes Discord doesn't surface a
+// limit for in response headers (e.g. reactions, at 1 request per 250ms).
+type CustomRateLimit struct {
+	Contains string
+	Requests int
+	Reset    time.Duration
 }
 
+// ReactionsRateLimit is Discord's undocumented reaction-route limit: one
+// request every 250ms. It's provided as a ready-to-use CustomRateLimit for
+// callers that add reaction endpoints to Limiter.CustomLimits.
+var ReactionsRateLimit = &CustomRateLimit{Contains: "/reactions/", Requests: 1, Reset: 250 * time.Millisecond}
+
 type bucket struct {
 	lock      sync.Mutex
 	reset     time.Time
 	remaining uint64
+
+	// custom is set at creation time if the bucket's path matched one of
+	// Limiter.CustomLimits. customSince is when the current custom window
+	// started and customCount is how many requests it has seen so far.
+	custom      *CustomRateLimit
+	customSince time.Time
+	customCount int
 }
 
 func NewLimiter() *Limiter {
-	return &Limiter{buckets: map[string]*bucket{}}
+	return &Limiter{buckets: map[string]*bucket{}, global: new(int64)}
 }
 
 func (l *Limiter) getBucket(path string, store bool) *bucket {
+	key := ParseBucketKey(path)
+
 	l.bucketMu.Lock()
 	defer l.bucketMu.Unlock()
 
-	b, ok := l.buckets[path]
+	b, ok := l.buckets[key]
 	if !ok && store {
 		b = &bucket{remaining: 1}
-		l.buckets[path] = b
+		for _, cl := range l.CustomLimits {
+			if strings.Contains(key, cl.Contains) {
+				b.custom = cl
+				break
+			}
+		}
+		l.buckets[key] = b
 	}
 	return b
 }
 
-func (l *Limiter) Acquire(path string) {
-	now := time.Now()
+// idPlaceholder replaces any path segment that isn't a major parameter when
+// computing a bucket key.
+const idPlaceholder = ":id"
+
+// majorParams are the path segments after which Discord scopes rate limit
+// buckets, as documented at https://discord.com/developers/docs/topics/rate-limits.
+var majorParams = map[string]bool{
+	"channels": true,
+	"guilds":   true,
+	"webhooks": true,
+}
+
+// ParseBucketKey collapses a Discord REST path into the canonical bucket key
+// Discord actually rate limits on, the same way discordgo/arikawa do: the
+// "major" parameter right after /channels, /guilds or /webhooks is kept
+// intact, and every other ID-like segment is rewritten to idPlaceholder so
+// that, e.g., two messages in the same channel share a bucket instead of
+// each minting their own. Reaction routes (/reactions/{emoji}/{user}) are
+// collapsed to a single stable suffix so a CustomRateLimit can match them.
+func ParseBucketKey(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	out := make([]string, 0, len(segments))
+
+	for i := 0; i < len(segments); i++ {
+		seg := segments[i]
+
+		switch {
+		case majorParams[seg]:
+			out = append(out, seg)
+			if i+1 < len(segments) {
+				i++
+				out = append(out, segments[i])
+			}
+			// /webhooks/{id}/{token} keeps the token as part of the major
+			// parameter too, since it identifies the webhook just as much
+			// as the ID does.
+			if seg == "webhooks" && i+1 < len(segments) {
+				i++
+				out = append(out, segments[i])
+			}
+
+		case seg == "reactions":
+			out = append(out, seg, idPlaceholder)
+			// The emoji and user ID segments that follow don't affect the
+			// limit Discord enforces, so collapse them all into the suffix
+			// above rather than rewriting each individually.
+			i = len(segments) - 1
 
-	// Check global rate limit
-	if l.global.After(now) {
-		time.Sleep(l.global.Sub(now) + ExtraDelay)
+		case isIDSegment(seg):
+			out = append(out, idPlaceholder)
+
+		default:
+			out = append(out, seg)
+		}
 	}
 
-	b := l.getBucket(path, true)
+	return "/" + strings.Join(out, "/")
+}
 
-	// Check bucket-specific rate limit
-	if b.remaining == 0 && b.reset.After(now) {
-		time.Sleep(b.reset.Sub(now) + ExtraDelay)
+// isIDSegment reports whether seg looks like a Discord snowflake: an
+// all-digit segment at least 15 characters long. Non-numeric tokens are not
+// recognised and are kept as they are.
+func isIDSegment(seg string) bool {
+	if len(seg) < 15 {
+		return false
 	}
+	for _, r := range seg {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
 
-	if b.remaining > 0 {
+// Acquire blocks until path is clear to be requested, sleeping out any
+// pending global or bucket rate limit wait. Callers that need to cancel the
+// wait or fail fast on a saturated bucket should use AcquireCtx instead.
+func (l *Limiter) Acquire(path string) {
+	_ = l.AcquireCtx(context.Background(), path)
+}
+
+// AcquireCtx is like Acquire but honours ctx: if ctx is cancelled or its
+// deadline would be exceeded by the wait, it returns ctx.Err() or
+// ErrTimedOutEarly without sleeping out the full wait. AcquireOptions
+// attached to ctx via WithAcquireOptions can also force this behaviour with
+// DontWait, which is useful for bulk uploads that would rather route around
+// a saturated bucket than block a goroutine for many seconds.
+func (l *Limiter) AcquireCtx(ctx context.Context, path string) error {
+	opts := acquireOptionsFromContext(ctx)
+
+	// Check global rate limit.
+	if globalAt := time.Unix(0, atomic.LoadInt64(l.global)); globalAt.After(time.Now()) {
+		if err := waitOrTimeout(ctx, opts, globalAt.Sub(time.Now())+ExtraDelay); err != nil {
+			return err
+		}
+	}
+
+	b := l.getBucket(path, true)
+
+	// The bucket's lock only ever guards a read-decrement of its state, not
+	// the sleep itself: holding it across waitOrTimeout would make a
+	// fail-fast caller (DontWait, or a ctx about to expire) block on
+	// another goroutine's full wait before ever reaching its own checks.
+	// Each iteration re-validates the bucket's state after reacquiring the
+	// lock, so a woken-up goroutine never acts on stale remaining/reset/
+	// customCount.
+	for {
 		b.lock.Lock()
-		b.remaining--
+		now := time.Now()
+
+		// Custom limits aren't advertised by Discord, so enforce them
+		// locally instead of relying on b.remaining/b.reset. Requests
+		// acquisitions are allowed within each Reset window before a
+		// caller has to wait for the next one.
+		if b.custom != nil {
+			if now.Sub(b.customSince) >= b.custom.Reset {
+				b.customSince = now
+				b.customCount = 0
+			}
+
+			if b.customCount < b.custom.Requests {
+				b.customCount++
+				b.lock.Unlock()
+				return nil
+			}
+
+			wait := b.custom.Reset - now.Sub(b.customSince)
+			b.lock.Unlock()
+			if err := waitOrTimeout(ctx, opts, wait); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Check bucket-specific rate limit.
+		if b.remaining == 0 && b.reset.After(now) {
+			wait := b.reset.Sub(now) + ExtraDelay
+			b.lock.Unlock()
+			if err := waitOrTimeout(ctx, opts, wait); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if b.remaining > 0 {
+			b.remaining--
+		}
 		b.lock.Unlock()
+		return nil
+	}
+}
+
+// waitOrTimeout sleeps out wait, unless opts.DontWait is set or ctx's
+// deadline would be exceeded by the wait, in which case it returns
+// ErrTimedOutEarly. It also returns early with ctx.Err() if ctx is
+// cancelled during the wait.
+func waitOrTimeout(ctx context.Context, opts AcquireOptions, wait time.Duration) error {
+	if opts.DontWait {
+		return ErrTimedOutEarly
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+		return ErrTimedOutEarly
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -72,6 +296,14 @@ func (l *Limiter) Release(path string, headers http.Header) {
 	}
 	b.lock.Lock()
 	defer b.lock.Unlock()
+
+	// Custom buckets are governed entirely by customSince/customCount and
+	// their Requests/Reset window, not by headers, so none of the headers
+	// (a global Retry-After included) are applied here.
+	if b.custom != nil {
+		return
+	}
+
 	var (
 		// boolean
 		global = headers.Get("X-RateLimit-Global")
@@ -92,7 +324,7 @@ func (l *Limiter) Release(path string, headers http.Header) {
 
 		// probably "true"
 		if global != "" {
-			l.global = at
+			atomic.StoreInt64(l.global, at.UnixNano())
 		} else {
 			b.reset = at
 		}
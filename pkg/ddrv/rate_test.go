@@ -0,0 +1,203 @@
+package ddrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rateLimitHeaders builds the X-RateLimit-* headers Release expects for a
+// bucket with remaining requests left and a reset resetIn in the future.
+func rateLimitHeaders(remaining int, resetIn time.Duration) http.Header {
+	h := http.Header{}
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatFloat(float64(time.Now().Add(resetIn).UnixNano())/float64(time.Second), 'f', -1, 64))
+	return h
+}
+
+// exhaustBucket creates path's bucket and leaves it rate limited with the
+// given reset, the way a real 429/low-remaining response would.
+func exhaustBucket(t *testing.T, l *Limiter, path string, resetIn time.Duration) {
+	t.Helper()
+	if err := l.AcquireCtx(context.Background(), path); err != nil {
+		t.Fatalf("setup acquire: %v", err)
+	}
+	l.Release(path, rateLimitHeaders(0, resetIn))
+}
+
+func TestAcquireCtx_DontWaitReturnsEarly(t *testing.T) {
+	l := NewLimiter()
+	path := "/channels/123456789012345/messages"
+	exhaustBucket(t, l, path, 5*time.Second)
+
+	ctx := WithAcquireOptions(context.Background(), AcquireOptions{DontWait: true})
+
+	start := time.Now()
+	err := l.AcquireCtx(ctx, path)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrTimedOutEarly) {
+		t.Fatalf("AcquireCtx() error = %v, want ErrTimedOutEarly", err)
+	}
+	if elapsed > 200*time.Millisecond {
+		t.Fatalf("AcquireCtx() took %s, want near-immediate return", elapsed)
+	}
+}
+
+func TestAcquireCtx_DeadlineExceededReturnsEarly(t *testing.T) {
+	l := NewLimiter()
+	path := "/channels/123456789012345/messages"
+	exhaustBucket(t, l, path, 5*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := l.AcquireCtx(ctx, path)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrTimedOutEarly) {
+		t.Fatalf("AcquireCtx() error = %v, want ErrTimedOutEarly", err)
+	}
+	if elapsed > 200*time.Millisecond {
+		t.Fatalf("AcquireCtx() took %s, want near-immediate return", elapsed)
+	}
+}
+
+func TestAcquireCtx_ContextCancelledMidWait(t *testing.T) {
+	l := NewLimiter()
+	path := "/channels/123456789012345/messages"
+	exhaustBucket(t, l, path, 2*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := l.AcquireCtx(ctx, path)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("AcquireCtx() error = %v, want context.Canceled", err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("AcquireCtx() took %s to observe cancellation", elapsed)
+	}
+}
+
+func TestParseBucketKey(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{
+			name: "channel major param kept, message id rewritten",
+			path: "/channels/123456789012345/messages/987654321098765",
+			want: "/channels/123456789012345/messages/:id",
+		},
+		{
+			name: "webhook id and token both kept",
+			path: "/webhooks/123456789012345/abcDEF123tokenabcDEF123token",
+			want: "/webhooks/123456789012345/abcDEF123tokenabcDEF123token",
+		},
+		{
+			name: "guild major param kept, member id rewritten",
+			path: "/guilds/123456789012345/members/987654321098765",
+			want: "/guilds/123456789012345/members/:id",
+		},
+		{
+			name: "reactions emoji and user collapse into one suffix",
+			path: "/channels/123456789012345/messages/987654321098765/reactions/%F0%9F%91%8D/555555555555555",
+			want: "/channels/123456789012345/messages/:id/reactions/:id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseBucketKey(tt.path); got != tt.want {
+				t.Errorf("ParseBucketKey(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquireCtx_CustomRateLimitAllowsConfiguredRequestsPerWindow(t *testing.T) {
+	l := NewLimiter()
+	l.CustomLimits = []*CustomRateLimit{
+		{Contains: "/reactions/", Requests: 3, Reset: 150 * time.Millisecond},
+	}
+	path := "/channels/123456789012345/messages/987654321098765/reactions/%F0%9F%91%8D/555555555555555"
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if err := l.AcquireCtx(context.Background(), path); err != nil {
+			t.Fatalf("acquisition %d: unexpected error: %v", i, err)
+		}
+		if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+			t.Fatalf("acquisition %d took %s, want immediate (within window budget)", i, elapsed)
+		}
+	}
+
+	ctx := WithAcquireOptions(context.Background(), AcquireOptions{DontWait: true})
+	if err := l.AcquireCtx(ctx, path); !errors.Is(err, ErrTimedOutEarly) {
+		t.Fatalf("4th acquisition: error = %v, want ErrTimedOutEarly once the window budget is exhausted", err)
+	}
+}
+
+// TestAcquireRelease_ConcurrentSameBucket hammers Acquire/Release from many
+// goroutines on the same bucket. Run with -race: b.remaining/b.reset used to
+// be read outside b.lock, which this test catches. The headers it releases
+// carry no global limit, so l.global is only read here, never written.
+func TestAcquireRelease_ConcurrentSameBucket(t *testing.T) {
+	l := NewLimiter()
+	path := "/channels/123456789012345/messages"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Acquire(path)
+			l.Release(path, rateLimitHeaders(5, 50*time.Millisecond))
+		}()
+	}
+	wg.Wait()
+}
+
+// TestAcquireCtx_DontWaitDoesNotBlockOnAnotherGoroutinesSleep checks that
+// b.lock is not held across a wait: a DontWait caller on a bucket another
+// goroutine is already sleeping out must fail fast instead of blocking until
+// that sleep finishes.
+func TestAcquireCtx_DontWaitDoesNotBlockOnAnotherGoroutinesSleep(t *testing.T) {
+	l := NewLimiter()
+	path := "/channels/123456789012345/messages"
+	exhaustBucket(t, l, path, 2*time.Second)
+
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		_ = l.AcquireCtx(context.Background(), path)
+	}()
+	<-started
+	time.Sleep(50 * time.Millisecond) // let the goroutine above release b.lock and start sleeping
+
+	ctx := WithAcquireOptions(context.Background(), AcquireOptions{DontWait: true})
+
+	start := time.Now()
+	err := l.AcquireCtx(ctx, path)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrTimedOutEarly) {
+		t.Fatalf("AcquireCtx() error = %v, want ErrTimedOutEarly", err)
+	}
+	if elapsed > 200*time.Millisecond {
+		t.Fatalf("AcquireCtx() took %s — it blocked on another goroutine's wait on the same bucket", elapsed)
+	}
+}